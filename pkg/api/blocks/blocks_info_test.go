@@ -0,0 +1,54 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+func TestBlocksInfo_Set(t *testing.T) {
+	staleBlocks := []metadata.Meta{{}}
+	freshBlocks := []metadata.Meta{{}, {}}
+	syncErr := errors.New("sync failed")
+
+	t.Run("success replaces blocks, warnings and clears Err", func(t *testing.T) {
+		b := &BlocksInfo{Blocks: staleBlocks, Err: errors.New("previous error")}
+
+		b.set(freshBlocks, []string{"warn1"}, nil)
+
+		require.Equal(t, freshBlocks, b.Blocks)
+		require.Equal(t, []string{"warn1"}, b.Warnings)
+		require.NoError(t, b.Err)
+	})
+
+	t.Run("error keeps last-known-good Blocks but still sets Err", func(t *testing.T) {
+		b := &BlocksInfo{Blocks: staleBlocks}
+
+		b.set(freshBlocks, nil, syncErr)
+
+		require.Equal(t, staleBlocks, b.Blocks)
+		require.Equal(t, syncErr, b.Err)
+	})
+
+	t.Run("warnings are replaced on every call, including a failing one", func(t *testing.T) {
+		b := &BlocksInfo{Warnings: []string{"stale warning"}}
+
+		b.set(freshBlocks, []string{"new warning"}, syncErr)
+
+		require.Equal(t, []string{"new warning"}, b.Warnings)
+	})
+
+	t.Run("warnings are cleared when a later sync reports none", func(t *testing.T) {
+		b := &BlocksInfo{Warnings: []string{"stale warning"}}
+
+		b.set(freshBlocks, nil, nil)
+
+		require.Nil(t, b.Warnings)
+	})
+}
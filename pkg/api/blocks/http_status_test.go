@@ -0,0 +1,82 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/route"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block"
+	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
+)
+
+// newTestRouter registers bapi on a fresh router the same way the real
+// binary does, so these tests exercise withAcceptedStatus through the whole
+// Register/instr chain rather than calling acceptedStatusWriter directly.
+func newTestRouter(t *testing.T, bapi *BlocksAPI) *route.Router {
+	t.Helper()
+
+	r := route.New()
+	bapi.Register(r, opentracing.NoopTracer{}, log.NewNopLogger(), extpromhttp.NewNopInstrumentationMiddleware(), nil)
+	return r
+}
+
+func TestMarkBlock_ReturnsAccepted(t *testing.T) {
+	bkt := objstore.NewInMemBucket()
+	bapi := NewBlocksAPI(log.NewNopLogger(), nil, false, "", map[string]string{}, bkt, nil, nil, "")
+	router := newTestRouter(t, bapi)
+
+	id := ulid.MustNew(1, nil)
+	form := url.Values{"id": {id.String()}, "action": {"DELETION"}}
+	req := httptest.NewRequest(http.MethodPost, "/blocks/mark?"+form.Encode(), nil)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusAccepted, w.Code)
+}
+
+func TestUnmarkBlock_ReturnsAccepted(t *testing.T) {
+	bkt := objstore.NewInMemBucket()
+	bapi := NewBlocksAPI(log.NewNopLogger(), nil, false, "", map[string]string{}, bkt, nil, nil, "")
+	router := newTestRouter(t, bapi)
+
+	id := ulid.MustNew(2, nil)
+	require.NoError(t, block.MarkForDeletion(context.Background(), log.NewNopLogger(), bkt, id, "", promauto.With(prometheus.NewRegistry()).NewCounter(prometheus.CounterOpts{Name: "test_marked"})))
+
+	form := url.Values{"id": {id.String()}, "action": {"DELETION"}}
+	req := httptest.NewRequest(http.MethodPost, "/blocks/unmark?"+form.Encode(), nil)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusAccepted, w.Code)
+}
+
+func TestBlocks_DoesNotGetUpgradedToAccepted(t *testing.T) {
+	// withAcceptedStatus is only wired onto /blocks/mark and /blocks/unmark;
+	// every other handler must keep returning its normal status.
+	bkt := objstore.NewInMemBucket()
+	bapi := NewBlocksAPI(log.NewNopLogger(), nil, false, "", map[string]string{}, bkt, nil, nil, "")
+	router := newTestRouter(t, bapi)
+
+	req := httptest.NewRequest(http.MethodGet, "/blocks", nil)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,346 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// JobState is the lifecycle state of an async admin-operation job.
+type JobState string
+
+const (
+	JobPending   JobState = "pending"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+const (
+	// maxJobs bounds the total number of jobs the queue tracks at once,
+	// pending/running/finished combined. The oldest finished job is evicted
+	// to make room for a new one; if none are finished, enqueue rejects the
+	// new job with errJobQueueFull rather than growing past this bound.
+	maxJobs = 1000
+	// jobWorkers is the number of goroutines draining the job queue.
+	jobWorkers = 4
+	// maxJobAttempts bounds retries of a job against transient bucket
+	// errors before it's reported as failed.
+	maxJobAttempts = 3
+	// jobRetryBaseWait is the base of the exponential backoff between job
+	// attempts.
+	jobRetryBaseWait = 200 * time.Millisecond
+)
+
+var (
+	errJobNotFound       = errors.New("job not found")
+	errJobNotCancellable = errors.New("job is no longer pending")
+	errJobQueueFull      = errors.New("blocks API job queue is at capacity, try again later")
+)
+
+// Job tracks a single async mark/unmark operation enqueued by BlocksAPI. All
+// reads and writes of a Job's fields, including by process(), happen under
+// jobQueue.mtx so that get()/list() never observe a torn update.
+type Job struct {
+	ID          ulid.ULID    `json:"id"`
+	Action      string       `json:"action"`
+	TargetULIDs []string     `json:"targetULIDs"`
+	State       JobState     `json:"state"`
+	Error       string       `json:"error,omitempty"`
+	Results     []MarkResult `json:"results,omitempty"`
+	StartedAt   time.Time    `json:"startedAt,omitempty"`
+	FinishedAt  time.Time    `json:"finishedAt,omitempty"`
+	Attempts    int          `json:"attempts"`
+
+	actionType ActionType
+	mark       bool
+	detail     string
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// jobQueue runs mark/unmark operations in the background, keeping a bounded
+// history of their outcome so the viewer can poll for completion instead of
+// blocking an HTTP request on a potentially slow or rate-limited bucket.
+type jobQueue struct {
+	logger log.Logger
+	exec   func(ctx context.Context, ids []string, action ActionType, detail string, mark bool) []MarkResult
+
+	mtx   sync.Mutex
+	jobs  map[ulid.ULID]*Job
+	order *list.List
+	work  chan ulid.ULID
+
+	jobsTotal   *prometheus.CounterVec
+	jobDuration *prometheus.HistogramVec
+}
+
+func newJobQueue(logger log.Logger, reg prometheus.Registerer, exec func(ctx context.Context, ids []string, action ActionType, detail string, mark bool) []MarkResult) *jobQueue {
+	q := &jobQueue{
+		logger: logger,
+		exec:   exec,
+		jobs:   make(map[ulid.ULID]*Job, maxJobs),
+		order:  list.New(),
+		work:   make(chan ulid.ULID, maxJobs),
+		jobsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_blocks_api_jobs_total",
+			Help: "Total number of admin operation jobs processed by the Block Viewer API, by action and state (pending on enqueue, then succeeded or failed).",
+		}, []string{"action", "state"}),
+		jobDuration: promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "thanos_blocks_api_job_duration_seconds",
+			Help:    "Duration of admin operation jobs processed by the Block Viewer API.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"action"}),
+	}
+	for i := 0; i < jobWorkers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+// jobActionName builds the Action label stored on the job and reported on
+// the jobsTotal counter, e.g. "MARK_DELETION" or "UNMARK_NO_COMPACTION".
+func jobActionName(action ActionType, mark bool) string {
+	verb := "MARK"
+	if !mark {
+		verb = "UNMARK"
+	}
+	switch action {
+	case Deletion:
+		return verb + "_DELETION"
+	case NoCompaction:
+		return verb + "_NO_COMPACTION"
+	default:
+		return verb + "_UNKNOWN"
+	}
+}
+
+// enqueue registers a new job and hands it to the worker pool. The job's
+// context is created here, not in process(), so that cancel() always has a
+// live CancelFunc to call even before a worker has picked the job up.
+//
+// If the queue is already tracking maxJobs entries and none of them are
+// finished (i.e. there's sustained enqueue pressure and workers are falling
+// behind), enqueue rejects the new job with errJobQueueFull instead of
+// growing the tracked set past maxJobs: the bound is on total tracked jobs,
+// not just finished ones sitting around for history.
+func (q *jobQueue) enqueue(actionType ActionType, mark bool, ids []string, detail string) (*Job, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:          ulid.MustNew(ulid.Now(), rand.Reader),
+		Action:      jobActionName(actionType, mark),
+		TargetULIDs: ids,
+		State:       JobPending,
+		actionType:  actionType,
+		mark:        mark,
+		detail:      detail,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	q.mtx.Lock()
+	q.evictFinishedLocked(maxJobs - 1)
+	if len(q.jobs) >= maxJobs {
+		q.mtx.Unlock()
+		cancel()
+		return nil, errJobQueueFull
+	}
+	q.jobs[job.ID] = job
+	q.order.PushBack(job.ID)
+	q.mtx.Unlock()
+
+	q.jobsTotal.WithLabelValues(job.Action, string(JobPending)).Inc()
+
+	select {
+	case q.work <- job.ID:
+	default:
+		// The channel is sized to maxJobs, so this should not normally
+		// happen. Log rather than block the HTTP handler that enqueued
+		// this job. The job stays tracked as pending but is not handed to
+		// a worker, so it is never run; it can still be cancelled.
+		level.Warn(q.logger).Log("msg", "blocks API job queue is full, job stays pending and is not handed to a worker", "job", job.ID)
+	}
+
+	return job, nil
+}
+
+// evictFinishedLocked drops the oldest finished jobs until at most target
+// entries remain tracked, so enqueue can make room for a new pending job.
+// Pending/running jobs are never evicted: if none remain to evict, the
+// tracked set stays over target and enqueue backs off instead. Caller must
+// hold q.mtx.
+func (q *jobQueue) evictFinishedLocked(target int) {
+	for len(q.jobs) > target {
+		evicted := false
+		for e := q.order.Front(); e != nil; e = e.Next() {
+			id := e.Value.(ulid.ULID)
+			job := q.jobs[id]
+			if job == nil || job.State == JobPending || job.State == JobRunning {
+				continue
+			}
+			q.order.Remove(e)
+			delete(q.jobs, id)
+			evicted = true
+			break
+		}
+		if !evicted {
+			return
+		}
+	}
+}
+
+// get returns a copy of the job with the given ID.
+func (q *jobQueue) get(id ulid.ULID) (*Job, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	cp := *job
+	return &cp, true
+}
+
+// list returns copies of all tracked jobs in creation order, optionally
+// filtered by state. An empty state matches every job.
+func (q *jobQueue) list(state JobState) []*Job {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	jobs := make([]*Job, 0, len(q.jobs))
+	for e := q.order.Front(); e != nil; e = e.Next() {
+		job := q.jobs[e.Value.(ulid.ULID)]
+		if job == nil {
+			continue
+		}
+		if state != "" && job.State != state {
+			continue
+		}
+		cp := *job
+		jobs = append(jobs, &cp)
+	}
+	return jobs
+}
+
+// cancel cancels a pending job. Jobs that are already running or finished
+// cannot be cancelled.
+func (q *jobQueue) cancel(id ulid.ULID) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return errJobNotFound
+	}
+	if job.State != JobPending {
+		return errJobNotCancellable
+	}
+
+	job.State = JobFailed
+	job.Error = "cancelled"
+	job.FinishedAt = time.Now()
+	job.cancel()
+	q.jobsTotal.WithLabelValues(job.Action, string(JobFailed)).Inc()
+	return nil
+}
+
+func (q *jobQueue) worker() {
+	for id := range q.work {
+		q.process(id)
+	}
+}
+
+// process runs a single job to completion. Every field of job is read and
+// written under q.mtx throughout so that concurrent get()/list() callers
+// never observe a torn update. Only IDs still failing are retried on each
+// attempt, with exponential backoff, up to maxJobAttempts; already-succeeded
+// IDs aren't re-issued against the bucket.
+func (q *jobQueue) process(id ulid.ULID) {
+	q.mtx.Lock()
+	job, ok := q.jobs[id]
+	if !ok || job.State != JobPending {
+		q.mtx.Unlock()
+		return
+	}
+	ctx := job.ctx
+	action, actionType, detail, mark := job.Action, job.actionType, job.detail, job.mark
+	targets := job.TargetULIDs
+	job.State = JobRunning
+	job.StartedAt = time.Now()
+	q.mtx.Unlock()
+
+	start := time.Now()
+	resultByID := make(map[string]MarkResult, len(targets))
+	remaining := targets
+	var lastErr error
+
+	for attempt := 1; attempt <= maxJobAttempts && len(remaining) > 0; attempt++ {
+		q.mtx.Lock()
+		job.Attempts = attempt
+		q.mtx.Unlock()
+
+		if ctx.Err() != nil {
+			lastErr = ctx.Err()
+			break
+		}
+
+		attemptResults := q.exec(ctx, remaining, actionType, detail, mark)
+		var failed []string
+		for _, r := range attemptResults {
+			resultByID[r.ID] = r
+			if !r.Success {
+				failed = append(failed, r.ID)
+			}
+		}
+		remaining = failed
+		if len(remaining) == 0 {
+			lastErr = nil
+			break
+		}
+		lastErr = errors.New(resultByID[remaining[0]].Error)
+		if attempt < maxJobAttempts {
+			level.Warn(q.logger).Log("msg", "retrying blocks API job after failure", "job", id, "attempt", attempt, "remaining", len(remaining), "err", lastErr)
+			select {
+			case <-time.After(jobRetryBaseWait * time.Duration(uint(1)<<uint(attempt-1))):
+			case <-ctx.Done():
+				lastErr = ctx.Err()
+			}
+		}
+	}
+
+	results := make([]MarkResult, 0, len(targets))
+	for _, tid := range targets {
+		if r, ok := resultByID[tid]; ok {
+			results = append(results, r)
+		}
+	}
+
+	q.mtx.Lock()
+	job.cancel()
+	job.Results = results
+	job.FinishedAt = time.Now()
+	if lastErr != nil {
+		job.State = JobFailed
+		job.Error = lastErr.Error()
+	} else {
+		job.State = JobSucceeded
+	}
+	state := job.State
+	q.mtx.Unlock()
+
+	q.jobsTotal.WithLabelValues(action, string(state)).Inc()
+	q.jobDuration.WithLabelValues(action).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,159 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestJobQueue(exec func(ctx context.Context, ids []string, action ActionType, detail string, mark bool) []MarkResult) *jobQueue {
+	return newJobQueue(log.NewNopLogger(), nil, exec)
+}
+
+func eventuallyState(t *testing.T, q *jobQueue, id ulid.ULID, want JobState) *Job {
+	t.Helper()
+
+	var job *Job
+	require.Eventually(t, func() bool {
+		j, ok := q.get(id)
+		if !ok {
+			return false
+		}
+		job = j
+		return j.State == want
+	}, 2*time.Second, time.Millisecond)
+	return job
+}
+
+func TestJobQueue_EnqueueRunSucceed(t *testing.T) {
+	q := newTestJobQueue(func(ctx context.Context, ids []string, action ActionType, detail string, mark bool) []MarkResult {
+		results := make([]MarkResult, len(ids))
+		for i, id := range ids {
+			results[i] = MarkResult{ID: id, Success: true}
+		}
+		return results
+	})
+
+	job, err := q.enqueue(Deletion, true, []string{"a", "b"}, "")
+	require.NoError(t, err)
+	got := eventuallyState(t, q, job.ID, JobSucceeded)
+
+	require.Equal(t, 1, got.Attempts)
+	require.Len(t, got.Results, 2)
+	for _, r := range got.Results {
+		require.True(t, r.Success)
+	}
+}
+
+func TestJobQueue_RetriesFailedIDsOnly(t *testing.T) {
+	var calls, aCalls int32
+
+	q := newTestJobQueue(func(ctx context.Context, ids []string, action ActionType, detail string, mark bool) []MarkResult {
+		attempt := atomic.AddInt32(&calls, 1)
+		results := make([]MarkResult, len(ids))
+		for i, id := range ids {
+			if id == "a" {
+				atomic.AddInt32(&aCalls, 1)
+			}
+			// "b" fails on the first attempt only; everything else always
+			// succeeds. If a retry re-issued the whole original batch
+			// instead of just the remaining failures, "a" would show up
+			// as processed twice.
+			if id == "b" && attempt == 1 {
+				results[i] = MarkResult{ID: id, Success: false, Error: "transient"}
+				continue
+			}
+			results[i] = MarkResult{ID: id, Success: true}
+		}
+		return results
+	})
+
+	job, err := q.enqueue(Deletion, true, []string{"a", "b"}, "")
+	require.NoError(t, err)
+	got := eventuallyState(t, q, job.ID, JobSucceeded)
+
+	require.GreaterOrEqual(t, int(atomic.LoadInt32(&calls)), 2)
+	require.Equal(t, int32(1), atomic.LoadInt32(&aCalls))
+	require.Equal(t, 2, got.Attempts)
+	require.Len(t, got.Results, 2)
+	for _, r := range got.Results {
+		require.True(t, r.Success)
+	}
+}
+
+func TestJobQueue_FailsAfterMaxAttempts(t *testing.T) {
+	q := newTestJobQueue(func(ctx context.Context, ids []string, action ActionType, detail string, mark bool) []MarkResult {
+		results := make([]MarkResult, len(ids))
+		for i, id := range ids {
+			results[i] = MarkResult{ID: id, Success: false, Error: "permanent"}
+		}
+		return results
+	})
+
+	job, err := q.enqueue(Deletion, true, []string{"a"}, "")
+	require.NoError(t, err)
+	got := eventuallyState(t, q, job.ID, JobFailed)
+
+	require.Equal(t, maxJobAttempts, got.Attempts)
+	require.NotEmpty(t, got.Error)
+}
+
+func TestJobQueue_CancelPendingJob(t *testing.T) {
+	// Occupy every worker with a blocking job so the next enqueued job is
+	// guaranteed to still be Pending when we cancel it.
+	release := make(chan struct{})
+	q := newTestJobQueue(func(ctx context.Context, ids []string, action ActionType, detail string, mark bool) []MarkResult {
+		<-release
+		results := make([]MarkResult, len(ids))
+		for i, id := range ids {
+			results[i] = MarkResult{ID: id, Success: true}
+		}
+		return results
+	})
+	defer close(release)
+
+	for i := 0; i < jobWorkers; i++ {
+		_, err := q.enqueue(Deletion, true, []string{"occupy"}, "")
+		require.NoError(t, err)
+	}
+
+	target, err := q.enqueue(Deletion, true, []string{"a"}, "")
+	require.NoError(t, err)
+	require.NoError(t, q.cancel(target.ID))
+
+	got, ok := q.get(target.ID)
+	require.True(t, ok)
+	require.Equal(t, JobFailed, got.State)
+	require.Equal(t, "cancelled", got.Error)
+
+	require.Equal(t, errJobNotCancellable, q.cancel(target.ID))
+}
+
+func TestJobQueue_RejectsEnqueueOnceFull(t *testing.T) {
+	// Block every worker so nothing ever reaches a finished state, then fill
+	// the queue to maxJobs with jobs that stay Pending/Running. The next
+	// enqueue must be rejected rather than growing the tracked set past
+	// maxJobs, since there's nothing finished left to evict.
+	release := make(chan struct{})
+	q := newTestJobQueue(func(ctx context.Context, ids []string, action ActionType, detail string, mark bool) []MarkResult {
+		<-release
+		return []MarkResult{{ID: ids[0], Success: true}}
+	})
+	defer close(release)
+
+	for i := 0; i < maxJobs; i++ {
+		_, err := q.enqueue(Deletion, true, []string{"occupy"}, "")
+		require.NoError(t, err)
+	}
+
+	_, err := q.enqueue(Deletion, true, []string{"one-too-many"}, "")
+	require.Equal(t, errJobQueueFull, err)
+}
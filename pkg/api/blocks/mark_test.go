@@ -0,0 +1,60 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMarkRequest_SingleIDForm(t *testing.T) {
+	form := url.Values{
+		"id":     {"01EXAMPLE0000000000000000"},
+		"action": {"DELETION"},
+		"detail": {"manual cleanup"},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/blocks/mark?"+form.Encode(), nil)
+
+	ids, action, detail, apiErr := parseMarkRequest(r)
+	require.Nil(t, apiErr)
+	require.Equal(t, []string{"01EXAMPLE0000000000000000"}, ids)
+	require.Equal(t, "DELETION", action)
+	require.Equal(t, "manual cleanup", detail)
+}
+
+func TestParseMarkRequest_SingleIDFormRequiresAction(t *testing.T) {
+	form := url.Values{"id": {"01EXAMPLE0000000000000000"}}
+	r := httptest.NewRequest(http.MethodPost, "/blocks/mark?"+form.Encode(), nil)
+
+	_, _, _, apiErr := parseMarkRequest(r)
+	require.NotNil(t, apiErr)
+}
+
+func TestParseMarkRequest_BulkJSONForm(t *testing.T) {
+	body := `{"ids":["a","b"],"action":"NO_COMPACTION","detail":"bulk"}`
+	r := httptest.NewRequest(http.MethodPost, "/blocks/mark", strings.NewReader(body))
+
+	ids, action, detail, apiErr := parseMarkRequest(r)
+	require.Nil(t, apiErr)
+	require.Equal(t, []string{"a", "b"}, ids)
+	require.Equal(t, "NO_COMPACTION", action)
+	require.Equal(t, "bulk", detail)
+}
+
+func TestParseMarkRequest_BulkJSONFormRequiresIDsAndAction(t *testing.T) {
+	for _, body := range []string{
+		`{"ids":[],"action":"DELETION"}`,
+		`{"ids":["a"],"action":""}`,
+		`not json`,
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/blocks/mark", strings.NewReader(body))
+		_, _, _, apiErr := parseMarkRequest(r)
+		require.NotNil(t, apiErr, "body %q should have failed to parse", body)
+	}
+}
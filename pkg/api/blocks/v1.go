@@ -5,18 +5,27 @@ package v1
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/oklog/ulid"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/route"
-	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/thanos-io/objstore"
 
 	"github.com/thanos-io/thanos/pkg/api"
@@ -32,17 +41,21 @@ type Planner interface {
 
 // BlocksAPI is a very simple API used by Thanos Block Viewer.
 type BlocksAPI struct {
-	baseAPI           *api.BaseAPI
-	logger            log.Logger
-	globalBlocksInfo  *BlocksInfo
-	loadedBlocksInfo  *BlocksInfo
-	plannedBlocksInfo *BlocksInfo
-
-	globalLock, loadedLock, plannedLock sync.Mutex // Question: whether is plannedLock needed?
-	disableCORS                         bool
-	bkt                                 objstore.Bucket
-	disableAdminOperations              bool
-	planner                             Planner
+	baseAPI          *api.BaseAPI
+	logger           log.Logger
+	globalBlocksInfo *BlocksInfo
+	loadedBlocksInfo *BlocksInfo
+
+	globalLock, loadedLock sync.Mutex
+	disableCORS            bool
+	bkt                    objstore.Bucket
+	disableAdminOperations bool
+	planner                Planner
+	metaFetcher            block.MetaFetcher
+	// shardingLabel is the external Thanos label used to shard planned blocks
+	// across the `shard` query parameter, e.g. the tenant label.
+	shardingLabel string
+	jobs          *jobQueue
 }
 
 type BlocksInfo struct {
@@ -50,6 +63,33 @@ type BlocksInfo struct {
 	Blocks      []metadata.Meta `json:"blocks"`
 	RefreshedAt time.Time       `json:"refreshedAt"`
 	Err         error           `json:"err"`
+	// Warnings carries non-fatal sync issues (unparseable meta.json, external
+	// label mismatches, stale deletion marks, truncated bucket listings) that
+	// should be surfaced to the caller without invalidating the rest of the
+	// view, mirroring how promv1 splits Warnings off from error.
+	Warnings []string `json:"warnings"`
+}
+
+// PlannedGroup is a set of blocks sharing the same external labels and
+// downsampling resolution, together with the plan computed for them.
+type PlannedGroup struct {
+	GroupKey   string        `json:"groupKey"`
+	Blocks     []interface{} `json:"blocks"`
+	Resolution int64         `json:"resolution"`
+}
+
+// PlannedBlocksResponse is the response body of GET /blocks/plan.
+type PlannedBlocksResponse struct {
+	Groups      []PlannedGroup `json:"groups"`
+	RefreshedAt time.Time      `json:"refreshedAt"`
+}
+
+// dryRunBlock annotates a planned meta with the output block that would be
+// produced if the plan were actually executed, without performing any writes.
+type dryRunBlock struct {
+	metadata.Meta
+	ProjectedULID  ulid.ULID `json:"projectedULID"`
+	ProjectedLevel int       `json:"projectedLevel"`
 }
 
 type ActionType int32
@@ -60,6 +100,10 @@ const (
 	Unknown
 )
 
+// maxConcurrentMarkOps bounds how many bucket mark/unmark operations a single
+// /blocks/mark or /blocks/unmark request fans out to at once.
+const maxConcurrentMarkOps = 10
+
 func parse(s string) ActionType {
 	switch s {
 	case "DELETION":
@@ -71,13 +115,31 @@ func parse(s string) ActionType {
 	}
 }
 
-// NewBlocksAPI creates a simple API to be used by Thanos Block Viewer.
-func NewBlocksAPI(logger log.Logger, disableCORS bool, label string, flagsMap map[string]string, bkt objstore.Bucket, planner Planner) *BlocksAPI {
+// markRequest is the bulk form of /blocks/mark and /blocks/unmark: a single
+// action applied to every block in IDs.
+type markRequest struct {
+	IDs    []string `json:"ids"`
+	Action string   `json:"action"`
+	Detail string   `json:"detail"`
+}
+
+// MarkResult reports the outcome of marking or unmarking a single block.
+type MarkResult struct {
+	ID      string `json:"id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// NewBlocksAPI creates a simple API to be used by Thanos Block Viewer. reg is
+// used to register the async job queue's metrics; it may be nil.
+func NewBlocksAPI(logger log.Logger, reg prometheus.Registerer, disableCORS bool, label string, flagsMap map[string]string, bkt objstore.Bucket, planner Planner, metaFetcher block.MetaFetcher, shardingLabel string) *BlocksAPI {
 	disableAdminOperations := flagsMap["disable-admin-operations"] == "true"
-	return &BlocksAPI{
-		baseAPI: api.NewBaseAPI(logger, disableCORS, flagsMap),
-		logger:  logger,
-		planner: planner,
+	bapi := &BlocksAPI{
+		baseAPI:       api.NewBaseAPI(logger, disableCORS, flagsMap),
+		logger:        logger,
+		planner:       planner,
+		metaFetcher:   metaFetcher,
+		shardingLabel: shardingLabel,
 		globalBlocksInfo: &BlocksInfo{
 			Blocks: []metadata.Meta{},
 			Label:  label,
@@ -90,6 +152,8 @@ func NewBlocksAPI(logger log.Logger, disableCORS bool, label string, flagsMap ma
 		bkt:                    bkt,
 		disableAdminOperations: disableAdminOperations,
 	}
+	bapi.jobs = newJobQueue(logger, reg, bapi.runMarkJob)
+	return bapi
 }
 
 func (bapi *BlocksAPI) Register(r *route.Router, tracer opentracing.Tracer, logger log.Logger, ins extpromhttp.InstrumentationMiddleware, logMiddleware *logging.HTTPServerMiddleware) {
@@ -98,47 +162,214 @@ func (bapi *BlocksAPI) Register(r *route.Router, tracer opentracing.Tracer, logg
 	instr := api.GetInstr(tracer, logger, ins, logMiddleware, bapi.disableCORS)
 
 	r.Get("/blocks", instr("blocks", bapi.blocks))
-	r.Post("/blocks/mark", instr("blocks_mark", bapi.markBlock))
+	r.Post("/blocks/mark", withAcceptedStatus(instr("blocks_mark", bapi.markBlock)))
+	r.Post("/blocks/unmark", withAcceptedStatus(instr("blocks_unmark", bapi.unmarkBlock)))
 	r.Get("/blocks/plan", instr("blocks_plan", bapi.plannedBlocks))
+	r.Get("/blocks/jobs", instr("blocks_jobs", bapi.listJobs))
+	r.Get("/blocks/jobs/:id", instr("blocks_jobs_get", bapi.getJob))
+	r.Del("/blocks/jobs/:id", instr("blocks_jobs_cancel", bapi.cancelJob))
+}
+
+// acceptedStatusWriter wraps a ResponseWriter so that a handler's successful
+// 200 is reported to the caller as 202 Accepted. BaseAPI's instrumented
+// handler always writes 200 on a nil *api.ApiError, with no per-handler way
+// to override it, so the status is upgraded here instead; error responses
+// (4xx/5xx, written by BaseAPI itself via a different status code) pass
+// through unchanged.
+type acceptedStatusWriter struct {
+	http.ResponseWriter
+}
+
+func (w *acceptedStatusWriter) WriteHeader(status int) {
+	if status == http.StatusOK {
+		status = http.StatusAccepted
+	}
+	w.ResponseWriter.WriteHeader(status)
 }
 
+// withAcceptedStatus wraps an already-instrumented handler so that its
+// successful response is reported as 202 Accepted rather than 200 OK,
+// signalling to callers that the operation was enqueued rather than
+// completed. Used only for /blocks/mark and /blocks/unmark, whose handlers
+// enqueue an async job and never perform the bucket write inline.
+func withAcceptedStatus(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(&acceptedStatusWriter{ResponseWriter: w}, r)
+	}
+}
+
+// parseMarkRequest accepts either the single-ID form (`id`, `action`,
+// `detail` form values) or the bulk JSON body {"ids", "action", "detail"}.
+func parseMarkRequest(r *http.Request) (ids []string, action, detail string, apiErr *api.ApiError) {
+	if idParam := r.FormValue("id"); idParam != "" {
+		action = r.FormValue("action")
+		if action == "" {
+			return nil, "", "", &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("Action cannot be empty")}
+		}
+		return []string{idParam}, action, r.FormValue("detail"), nil
+	}
+
+	var req markRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, "", "", &api.ApiError{Typ: api.ErrorBadData, Err: errors.Wrap(err, "decode request body")}
+	}
+	if len(req.IDs) == 0 {
+		return nil, "", "", &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("ids cannot be empty")}
+	}
+	if req.Action == "" {
+		return nil, "", "", &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("Action cannot be empty")}
+	}
+	return req.IDs, req.Action, req.Detail, nil
+}
+
+// jobAcceptedResponse is the HTTP 202 Accepted body returned by /blocks/mark
+// and /blocks/unmark once an operation has been enqueued. The caller is
+// expected to poll /blocks/jobs/{id} for the outcome rather than wait on the
+// request.
+type jobAcceptedResponse struct {
+	JobID  string `json:"jobId"`
+	Status string `json:"status"`
+}
+
+// markBlock enqueues a mark-for-deletion or mark-for-no-compaction operation
+// and returns immediately; bucket writes happen asynchronously on the job
+// queue so large buckets or rate-limited object stores can't block the
+// viewer UI or time out the request.
 func (bapi *BlocksAPI) markBlock(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
 	if bapi.disableAdminOperations {
 		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("Admin operations are disabled")}, func() {}
 	}
-	idParam := r.FormValue("id")
-	actionParam := r.FormValue("action")
-	detailParam := r.FormValue("detail")
 
-	if idParam == "" {
-		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("ID cannot be empty")}, func() {}
+	ids, actionParam, detailParam, apiErr := parseMarkRequest(r)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
 	}
 
-	if actionParam == "" {
-		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("Action cannot be empty")}, func() {}
+	actionType := parse(actionParam)
+	if actionType == Unknown {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("not supported marker %v", actionParam)}, func() {}
 	}
 
-	id, err := ulid.Parse(idParam)
+	job, err := bapi.jobs.enqueue(actionType, true, ids, detailParam)
 	if err != nil {
-		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("ULID %q is not valid: %v", idParam, err)}, func() {}
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: err}, func() {}
+	}
+	return jobAcceptedResponse{JobID: job.ID.String(), Status: string(job.State)}, nil, nil, func() {}
+}
+
+// unmarkBlock removes a previously set deletion-mark.json or
+// no-compact-mark.json, allowing operators to recover from a mis-mark
+// without editing the bucket by hand. Like markBlock, it enqueues the work
+// and returns a job to poll rather than performing the bucket write inline.
+func (bapi *BlocksAPI) unmarkBlock(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
+	if bapi.disableAdminOperations {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.New("Admin operations are disabled")}, func() {}
+	}
+
+	ids, actionParam, _, apiErr := parseMarkRequest(r)
+	if apiErr != nil {
+		return nil, nil, apiErr, func() {}
 	}
 
 	actionType := parse(actionParam)
-	switch actionType {
-	case Deletion:
-		err := block.MarkForDeletion(r.Context(), bapi.logger, bapi.bkt, id, detailParam, promauto.With(nil).NewCounter(prometheus.CounterOpts{}))
-		if err != nil {
-			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
-		}
-	case NoCompaction:
-		err := block.MarkForNoCompact(r.Context(), bapi.logger, bapi.bkt, id, metadata.ManualNoCompactReason, detailParam, promauto.With(nil).NewCounter(prometheus.CounterOpts{}))
-		if err != nil {
-			return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
-		}
-	default:
+	if actionType == Unknown {
 		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("not supported marker %v", actionParam)}, func() {}
 	}
-	return nil, nil, nil, func() {}
+
+	job, err := bapi.jobs.enqueue(actionType, false, ids, "")
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: err}, func() {}
+	}
+	return jobAcceptedResponse{JobID: job.ID.String(), Status: string(job.State)}, nil, nil, func() {}
+}
+
+// listJobs returns all tracked admin-operation jobs, optionally filtered by
+// their `state` query parameter (pending/running/succeeded/failed).
+func (bapi *BlocksAPI) listJobs(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
+	return bapi.jobs.list(JobState(r.URL.Query().Get("state"))), nil, nil, func() {}
+}
+
+// getJob returns the detail of a single tracked job.
+func (bapi *BlocksAPI) getJob(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
+	id, err := ulid.Parse(route.Param(r.Context(), "id"))
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("job ID is not a valid ULID: %v", err)}, func() {}
+	}
+
+	job, ok := bapi.jobs.get(id)
+	if !ok {
+		return nil, nil, &api.ApiError{Typ: api.ErrorNotFound, Err: errors.Errorf("job %s not found", id)}, func() {}
+	}
+	return job, nil, nil, func() {}
+}
+
+// cancelJob cancels a pending job via context cancellation. Jobs that are
+// already running, succeeded or failed cannot be cancelled.
+func (bapi *BlocksAPI) cancelJob(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
+	id, err := ulid.Parse(route.Param(r.Context(), "id"))
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: errors.Errorf("job ID is not a valid ULID: %v", err)}, func() {}
+	}
+
+	switch err := bapi.jobs.cancel(id); err {
+	case nil:
+		return nil, nil, nil, func() {}
+	case errJobNotFound:
+		return nil, nil, &api.ApiError{Typ: api.ErrorNotFound, Err: err}, func() {}
+	default:
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
+	}
+}
+
+// runMarkJob fans the requested (un)mark operation out across ids, bounded
+// by maxConcurrentMarkOps, and collects a per-ID result so a single invalid
+// or failing ID doesn't fail the whole batch.
+func (bapi *BlocksAPI) runMarkJob(ctx context.Context, ids []string, action ActionType, detail string, mark bool) []MarkResult {
+	results := make([]MarkResult, len(ids))
+	sem := make(chan struct{}, maxConcurrentMarkOps)
+
+	var wg sync.WaitGroup
+	for i, idParam := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, idParam string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = bapi.markOne(ctx, idParam, action, detail, mark)
+		}(i, idParam)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (bapi *BlocksAPI) markOne(ctx context.Context, idParam string, action ActionType, detail string, mark bool) MarkResult {
+	res := MarkResult{ID: idParam}
+
+	id, err := ulid.Parse(idParam)
+	if err != nil {
+		res.Error = errors.Errorf("ULID %q is not valid: %v", idParam, err).Error()
+		return res
+	}
+
+	var opErr error
+	switch {
+	case mark && action == Deletion:
+		opErr = block.MarkForDeletion(ctx, bapi.logger, bapi.bkt, id, detail, promauto.With(nil).NewCounter(prometheus.CounterOpts{}))
+	case mark && action == NoCompaction:
+		opErr = block.MarkForNoCompact(ctx, bapi.logger, bapi.bkt, id, metadata.ManualNoCompactReason, detail, promauto.With(nil).NewCounter(prometheus.CounterOpts{}))
+	case !mark && action == Deletion:
+		opErr = block.UnmarkForDeletion(ctx, bapi.logger, bapi.bkt, id, promauto.With(nil).NewCounter(prometheus.CounterOpts{}))
+	case !mark && action == NoCompaction:
+		opErr = block.UnmarkForNoCompact(ctx, bapi.logger, bapi.bkt, id, promauto.With(nil).NewCounter(prometheus.CounterOpts{}))
+	}
+
+	if opErr != nil {
+		res.Error = opErr.Error()
+		return res
+	}
+	res.Success = true
+	return res
 }
 
 func (bapi *BlocksAPI) blocks(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
@@ -156,73 +387,256 @@ func (bapi *BlocksAPI) blocks(r *http.Request) (interface{}, []error, *api.ApiEr
 	return bapi.globalBlocksInfo, nil, nil, func() {}
 }
 
+// plannedBlocks fetches the current global meta set, groups blocks by their
+// external Thanos labels and downsampling resolution and runs the configured
+// Planner over each group. If a `shard` query parameter is given, only blocks
+// owned by that shard (as determined by hashing bapi.shardingLabel) are
+// considered. If `dryRun=true`, the response annotates each planned block
+// with the output ULID and compaction level that would result, without
+// performing any writes.
 func (bapi *BlocksAPI) plannedBlocks(r *http.Request) (interface{}, []error, *api.ApiError, func()) {
-	// TODO: fetch from planner.plan then mock data
-	mockBlocks := []metadata.Meta{
-		{
-			BlockMeta: tsdb.BlockMeta{
-				ULID:    ulid.MustParse("01EEB0ZRSQDJW51W11V4R6YP4T"),
-				MinTime: 1594629445222,
-				MaxTime: 1595455200000,
-				Stats: tsdb.BlockStats{
-					NumSamples: 1189126896,
-					NumSeries:  2492,
-					NumChunks:  10093065,
-				},
-				Compaction: tsdb.BlockMetaCompaction{
-					Level: 4,
-					Sources: []ulid.ULID{
-						ulid.MustParse("01EDBMV5FNTZXBZETENC7ZXY99"),
-						ulid.MustParse("01EE3BKGP8WSJAH3M4Y6D7XQVB"),
-						ulid.MustParse("01EDW1T6FWT1PDSE85WAGBF848"),
-						ulid.MustParse("01EEB0QH11ANV2845HJNEP1M8J"),
-					},
-				},
-			},
-			Thanos: metadata.Thanos{
-				Downsample: metadata.ThanosDownsample{
-					Resolution: 0,
-				},
-				Labels: map[string]string{
-					"monitor": "prometheus_two",
-				},
-				Source: "compactor",
-			},
-		},
+	if bapi.metaFetcher == nil || bapi.planner == nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.New("planner is not configured")}, func() {}
+	}
+
+	shardID, shardTotal, err := parseShardParam(r.URL.Query().Get("shard"))
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorBadData, Err: err}, func() {}
+	}
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+
+	ctx := r.Context()
+	metas, partial, err := bapi.metaFetcher.Fetch(ctx)
+	if err != nil {
+		return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrap(err, "fetch block metas")}, func() {}
 	}
+	if len(partial) > 0 {
+		level.Warn(bapi.logger).Log("msg", "ignoring partial blocks while planning", "count", len(partial))
+	}
+
+	candidates := make(map[ulid.ULID]*metadata.Meta, len(metas))
+	for id, meta := range metas {
+		if shardTotal > 0 && !bapi.ownedByShard(id, meta, shardID, shardTotal) {
+			continue
+		}
+		candidates[id] = meta
+	}
+
+	byGroup := map[string][]*metadata.Meta{}
+	for _, meta := range bapi.filterMarked(ctx, candidates) {
+		key := groupKey(meta.Thanos)
+		byGroup[key] = append(byGroup[key], meta)
+	}
+
+	groups := make([]PlannedGroup, 0, len(byGroup))
+	for key, groupMetas := range byGroup {
+		sort.Slice(groupMetas, func(i, j int) bool { return groupMetas[i].MinTime < groupMetas[j].MinTime })
+
+		planned, err := bapi.planner.Plan(ctx, groupMetas)
+		if err != nil {
+			return nil, nil, &api.ApiError{Typ: api.ErrorInternal, Err: errors.Wrapf(err, "plan group %s", key)}, func() {}
+		}
+		if len(planned) == 0 {
+			continue
+		}
+
+		blocks := make([]interface{}, 0, len(planned))
+		if dryRun {
+			// A plan merges every source block in the group into a single
+			// output block, so the projected ULID/level is computed once per
+			// group and shared by every source block's entry, rather than
+			// fabricated independently per block.
+			projectedULID := ulid.MustNew(ulid.Now(), rand.Reader)
+			projectedLevel := 0
+			for _, meta := range planned {
+				if lvl := meta.Compaction.Level + 1; lvl > projectedLevel {
+					projectedLevel = lvl
+				}
+			}
+			for _, meta := range planned {
+				blocks = append(blocks, dryRunBlock{
+					Meta:           *meta,
+					ProjectedULID:  projectedULID,
+					ProjectedLevel: projectedLevel,
+				})
+			}
+		} else {
+			for _, meta := range planned {
+				blocks = append(blocks, *meta)
+			}
+		}
+
+		groups = append(groups, PlannedGroup{
+			GroupKey:   key,
+			Blocks:     blocks,
+			Resolution: groupMetas[0].Thanos.Downsample.Resolution,
+		})
+	}
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].GroupKey < groups[j].GroupKey })
 
-	return &BlocksInfo{
-		Blocks:      mockBlocks,
+	return &PlannedBlocksResponse{
+		Groups:      groups,
 		RefreshedAt: time.Now(),
-		Label:       "Planned Blocks",
 	}, nil, nil, func() {}
 }
 
-func (b *BlocksInfo) set(blocks []metadata.Meta, err error) {
+// parseShardParam parses a `<id>/<total>` shard query parameter. An empty
+// string means "no sharding" and is reported via a zero shardTotal.
+func parseShardParam(s string) (id, total uint64, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("invalid shard %q, expected format <id>/<total>", s)
+	}
+	id, err = strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid shard id %q", parts[0])
+	}
+	total, err = strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "invalid shard total %q", parts[1])
+	}
+	if total == 0 || id >= total {
+		return 0, 0, errors.Errorf("invalid shard %q: id must be less than total and total must be > 0", s)
+	}
+	return id, total, nil
+}
+
+// ownedByShard reports whether the block with the given id is owned by
+// shardID out of shardTotal, modelled on Cortex's ShuffleShardingPlanner:
+// ownership is derived by hashing the value of the configured sharding label
+// (typically the tenant). Blocks missing the sharding label fall back to
+// hashing their own ULID, so that exactly one shard — not every shard — ends
+// up owning them; without this fallback every shard would independently plan
+// (and, once acted on, compact) the same unlabeled blocks concurrently.
+func (bapi *BlocksAPI) ownedByShard(id ulid.ULID, meta *metadata.Meta, shardID, shardTotal uint64) bool {
+	if bapi.shardingLabel == "" {
+		return true
+	}
+
+	h := fnv.New64a()
+	if val, ok := meta.Thanos.Labels[bapi.shardingLabel]; ok {
+		_, _ = h.Write([]byte(val))
+	} else {
+		_, _ = h.Write(id[:])
+	}
+	return h.Sum64()%shardTotal == shardID
+}
+
+// maxConcurrentMarkerChecks bounds how many bucket Exists calls plannedBlocks
+// issues at once while filtering out already-marked blocks.
+const maxConcurrentMarkerChecks = 16
+
+// filterMarked returns the subset of candidates that are not already marked
+// for deletion or no-compaction. Checks run concurrently, bounded by
+// maxConcurrentMarkerChecks, rather than serially under a lock: plannedBlocks
+// is called by every shard's viewer and serializing it on bucket I/O would
+// turn a single slow or rate-limited store into a repo-wide stall. A single
+// block's check failing only drops that block, logged as a warning, instead
+// of aborting the whole response.
+func (bapi *BlocksAPI) filterMarked(ctx context.Context, candidates map[ulid.ULID]*metadata.Meta) map[ulid.ULID]*metadata.Meta {
+	type result struct {
+		id     ulid.ULID
+		marked bool
+		err    error
+	}
+
+	results := make(chan result, len(candidates))
+	sem := make(chan struct{}, maxConcurrentMarkerChecks)
+
+	var wg sync.WaitGroup
+	for id := range candidates {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id ulid.ULID) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			marked, err := bapi.isMarked(ctx, id)
+			results <- result{id: id, marked: marked, err: err}
+		}(id)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	unmarked := make(map[ulid.ULID]*metadata.Meta, len(candidates))
+	for res := range results {
+		if res.err != nil {
+			level.Warn(bapi.logger).Log("msg", "skipping block while planning, failed to check marker", "block", res.id, "err", res.err)
+			continue
+		}
+		if res.marked {
+			continue
+		}
+		unmarked[res.id] = candidates[res.id]
+	}
+	return unmarked
+}
+
+// isMarked reports whether the block is already marked for deletion or
+// no-compaction, in which case it should be excluded from planning.
+func (bapi *BlocksAPI) isMarked(ctx context.Context, id ulid.ULID) (bool, error) {
+	for _, marker := range []string{metadata.DeletionMarkFilename, metadata.NoCompactMarkFilename} {
+		ok, err := bapi.bkt.Exists(ctx, path.Join(id.String(), marker))
+		if err != nil {
+			return false, errors.Wrapf(err, "check marker %s for block %s", marker, id)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// groupKey mirrors compact.DefaultGroupKey: blocks are grouped by the hash of
+// their external labels and downsampling resolution. Hashing the label set,
+// rather than joining it into a delimited string, avoids two distinct label
+// sets colliding on the same key through an ambiguous separator (e.g. a label
+// value itself containing "," or "=").
+func groupKey(thanosMeta metadata.Thanos) string {
+	lbls := labels.FromMap(thanosMeta.Labels)
+	return fmt.Sprintf("%d@%d", lbls.Hash(), thanosMeta.Downsample.Resolution)
+}
+
+// set refreshes the view with the outcome of a sync. Warnings are always
+// replaced with the current set, even on failure, so non-fatal issues
+// (picked up on the way to a hard error) are never lost. Blocks, however,
+// are only replaced on success: the last-known-good list is kept on error so
+// a single failed sync doesn't blank out the viewer.
+func (b *BlocksInfo) set(blocks []metadata.Meta, warnings []string, err error) {
+	b.RefreshedAt = time.Now()
+	b.Warnings = warnings
+
 	if err != nil {
 		// Last view is maintained.
-		b.RefreshedAt = time.Now()
 		b.Err = err
 		return
 	}
 
-	b.RefreshedAt = time.Now()
 	b.Blocks = blocks
-	b.Err = err
+	b.Err = nil
 }
 
-// SetGlobal updates the global blocks' metadata in the API.
-func (bapi *BlocksAPI) SetGlobal(blocks []metadata.Meta, err error) {
+// SetGlobal updates the global blocks' metadata in the API. warnings reports
+// partial-sync conditions (unparseable meta.json, external label mismatches,
+// stale deletion marks, truncated bucket listings) that don't warrant
+// failing the whole sync.
+func (bapi *BlocksAPI) SetGlobal(blocks []metadata.Meta, warnings []string, err error) {
 	bapi.globalLock.Lock()
 	defer bapi.globalLock.Unlock()
 
-	bapi.globalBlocksInfo.set(blocks, err)
+	bapi.globalBlocksInfo.set(blocks, warnings, err)
 }
 
-// SetLoaded updates the local blocks' metadata in the API.
-func (bapi *BlocksAPI) SetLoaded(blocks []metadata.Meta, err error) {
+// SetLoaded updates the local blocks' metadata in the API. See SetGlobal for
+// the meaning of warnings.
+func (bapi *BlocksAPI) SetLoaded(blocks []metadata.Meta, warnings []string, err error) {
 	bapi.loadedLock.Lock()
 	defer bapi.loadedLock.Unlock()
 
-	bapi.loadedBlocksInfo.set(blocks, err)
+	bapi.loadedBlocksInfo.set(blocks, warnings, err)
 }
@@ -0,0 +1,104 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package v1
+
+import (
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+func TestGroupKey_DistinguishesAmbiguousLabelValues(t *testing.T) {
+	// These two label sets string-join to the same "x=1,y=2" under a naive
+	// comma/equals-delimited encoding, even though they are distinct label
+	// sets. groupKey must not collide them.
+	a := metadata.Thanos{Labels: map[string]string{"x": "1,y=2"}}
+	b := metadata.Thanos{Labels: map[string]string{"x": "1", "y": "2"}}
+
+	require.NotEqual(t, groupKey(a), groupKey(b))
+}
+
+func TestGroupKey_StableAndOrderIndependent(t *testing.T) {
+	a := metadata.Thanos{Labels: map[string]string{"tenant": "a", "replica": "0"}}
+	b := metadata.Thanos{Labels: map[string]string{"replica": "0", "tenant": "a"}}
+
+	require.Equal(t, groupKey(a), groupKey(b))
+}
+
+func TestGroupKey_ResolutionDistinguishesOtherwiseEqualLabels(t *testing.T) {
+	base := map[string]string{"tenant": "a"}
+	raw := metadata.Thanos{Labels: base, Downsample: metadata.ThanosDownsample{Resolution: 0}}
+	down := metadata.Thanos{Labels: base, Downsample: metadata.ThanosDownsample{Resolution: 5 * 60 * 1000}}
+
+	require.NotEqual(t, groupKey(raw), groupKey(down))
+}
+
+func TestParseShardParam(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		in            string
+		wantID, wantT uint64
+		wantErr       bool
+	}{
+		{name: "empty means no sharding", in: "", wantID: 0, wantT: 0},
+		{name: "valid", in: "1/3", wantID: 1, wantT: 3},
+		{name: "missing slash", in: "1", wantErr: true},
+		{name: "non-numeric id", in: "a/3", wantErr: true},
+		{name: "non-numeric total", in: "1/b", wantErr: true},
+		{name: "zero total", in: "0/0", wantErr: true},
+		{name: "id equal to total", in: "3/3", wantErr: true},
+		{name: "id greater than total", in: "4/3", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			id, total, err := parseShardParam(tc.in)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.wantID, id)
+			require.Equal(t, tc.wantT, total)
+		})
+	}
+}
+
+func TestOwnedByShard(t *testing.T) {
+	bapi := &BlocksAPI{shardingLabel: "tenant"}
+
+	t.Run("no sharding label configured means every shard owns it", func(t *testing.T) {
+		unconfigured := &BlocksAPI{}
+		meta := &metadata.Meta{Thanos: metadata.Thanos{Labels: map[string]string{"tenant": "a"}}}
+		id := ulid.MustNew(1, nil)
+		require.True(t, unconfigured.ownedByShard(id, meta, 0, 3))
+		require.True(t, unconfigured.ownedByShard(id, meta, 1, 3))
+		require.True(t, unconfigured.ownedByShard(id, meta, 2, 3))
+	})
+
+	t.Run("labelled block is owned by exactly one shard", func(t *testing.T) {
+		meta := &metadata.Meta{Thanos: metadata.Thanos{Labels: map[string]string{"tenant": "a"}}}
+		id := ulid.MustNew(2, nil)
+		owners := 0
+		for shard := uint64(0); shard < 4; shard++ {
+			if bapi.ownedByShard(id, meta, shard, 4) {
+				owners++
+			}
+		}
+		require.Equal(t, 1, owners)
+	})
+
+	t.Run("unlabelled block falls back to a single deterministic owner, not every shard", func(t *testing.T) {
+		meta := &metadata.Meta{Thanos: metadata.Thanos{Labels: map[string]string{}}}
+		id := ulid.MustNew(3, nil)
+		owners := 0
+		for shard := uint64(0); shard < 4; shard++ {
+			if bapi.ownedByShard(id, meta, shard, 4) {
+				owners++
+			}
+		}
+		require.Equal(t, 1, owners)
+	})
+}
@@ -0,0 +1,53 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package block
+
+import (
+	"context"
+	"path"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/objstore"
+
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// UnmarkForDeletion removes the deletion-mark.json previously written by
+// MarkForDeletion, restoring the block to normal consideration by the
+// compactor and store gateway.
+func UnmarkForDeletion(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, unmarkedForDeletion prometheus.Counter) error {
+	return deleteMark(ctx, logger, bkt, id, metadata.DeletionMarkFilename, unmarkedForDeletion)
+}
+
+// UnmarkForNoCompact removes the no-compact-mark.json previously written by
+// MarkForNoCompact, making the block eligible for compaction again.
+func UnmarkForNoCompact(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, unmarkedForNoCompact prometheus.Counter) error {
+	return deleteMark(ctx, logger, bkt, id, metadata.NoCompactMarkFilename, unmarkedForNoCompact)
+}
+
+func deleteMark(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, markFilename string, unmarked prometheus.Counter) error {
+	markPath := path.Join(id.String(), markFilename)
+
+	ok, err := bkt.Exists(ctx, markPath)
+	if err != nil {
+		return errors.Wrapf(err, "check mark file %s exists", markPath)
+	}
+	if !ok {
+		return errors.Errorf("block %s is not marked (missing %s)", id, markFilename)
+	}
+
+	if err := bkt.Delete(ctx, markPath); err != nil {
+		return errors.Wrapf(err, "delete mark file %s", markPath)
+	}
+
+	if unmarked != nil {
+		unmarked.Inc()
+	}
+	level.Info(logger).Log("msg", "unmarked block", "block", id, "file", markFilename)
+	return nil
+}